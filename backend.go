@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// RemoteFile is a backend-agnostic view of one synced file: enough for the
+// push/pull/bisync engine in sync_mode.go to diff against a local file
+// without knowing whether it came from Drive, S3, or a local filesystem.
+type RemoteFile struct {
+	ID      string
+	Path    string
+	Hash    string
+	ModTime time.Time
+	Size    int64
+}
+
+// HashType identifies which digest a backend's Hash field is comparable
+// against, since not every backend exposes MD5 the way Drive and S3 do.
+type HashType int
+
+const (
+	HashMD5 HashType = iota
+	HashSHA256
+)
+
+// computeLocal hashes a local file the same way the backend hashes its own
+// files, so the engine can tell whether a local and remote copy match.
+func (h HashType) computeLocal(path string) (string, error) {
+	switch h {
+	case HashSHA256:
+		return computeSHA256(path)
+	default:
+		return computeMD5(path)
+	}
+}
+
+func computeMD5(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to open file: %v", err)
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("unable to compute hash: %v", err)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func computeSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to open file: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("unable to compute hash: %v", err)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// Backend is the sync engine's view of a storage provider: list what's
+// there, move bytes in and out, make room for a file, and set aside a
+// conflicting copy. sync_mode.go drives push/pull/bisync entirely through
+// this interface so it never needs to know it's talking to Drive.
+type Backend interface {
+	// List returns every file under the backend's mapped root, keyed by
+	// path relative to that root. fullScan forces a provider to ignore any
+	// incremental-listing state it keeps (only meaningful to backends that
+	// support it, e.g. driveBackend's Changes API tracking).
+	List(fullScan bool) (map[string]RemoteFile, error)
+	Upload(localPath, relativePath string) (RemoteFile, error)
+	Update(localPath, relativePath string, remote RemoteFile) (RemoteFile, error)
+	Download(remote RemoteFile, destPath string) error
+	Delete(remote RemoteFile) error
+	// Rename preserves remote's current content under newName, used by the
+	// bisync "rename" conflict policy to keep the losing side instead of
+	// overwriting it.
+	Rename(remote RemoteFile, newName string) error
+	Hash() HashType
+}
+
+// backendSpec is one dir_map.json entry split into its scheme prefix
+// (gdrive, s3, file) and the location that prefix qualifies.
+type backendSpec struct {
+	Scheme   string
+	Location string
+	Raw      string
+}
+
+func parseBackendSpec(raw string) (backendSpec, error) {
+	scheme, location, found := strings.Cut(raw, ":")
+	if !found || scheme == "" || location == "" {
+		return backendSpec{}, fmt.Errorf("dir_map entry %q missing scheme prefix (want gdrive:, s3:, or file:)", raw)
+	}
+	return backendSpec{Scheme: scheme, Location: location, Raw: raw}, nil
+}
+
+// newBackend builds the Backend named by spec. srv/httpClient are only
+// needed for gdrive: mappings and may be nil otherwise.
+func newBackend(spec backendSpec, srv *drive.Service, httpClient *http.Client, p *pacer, opts *syncOptions) (Backend, error) {
+	switch spec.Scheme {
+	case "gdrive":
+		if srv == nil || httpClient == nil {
+			return nil, fmt.Errorf("gdrive backend requires Drive credentials")
+		}
+		return newDriveBackend(spec.Location, srv, httpClient, p, opts), nil
+	case "file":
+		return newFileBackend(spec.Location), nil
+	case "s3":
+		return nil, fmt.Errorf("s3 backend not implemented yet")
+	default:
+		return nil, fmt.Errorf("unknown backend scheme %q", spec.Scheme)
+	}
+}
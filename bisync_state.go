@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const bisyncStateFilePath = ".cloudsyncer-bisync-state.json"
+
+// bisyncStateMu serializes every load-mutate-save round trip against
+// bisyncStateFilePath. Each mapped directory reconciles in its own goroutine
+// and owns a different top-level key in an otherwise-shared file, so without
+// this the loser of two concurrent saves would silently drop the winner's
+// baseline.
+var bisyncStateMu sync.Mutex
+
+// bisyncBaseline is the last state both sides were known to agree on for a
+// given relative path, recorded after every successful bisync so the next
+// run can tell which side actually changed instead of just which side
+// differs (both always differ from each other on an ordinary first diff).
+// Unlike folderSyncState (changes.go), this applies to any Backend, so it's
+// keyed by the raw dir_map.json mapping (e.g. "gdrive:FOLDERID" or
+// "file:/path") rather than a Drive folder ID.
+type bisyncBaseline struct {
+	LocalChecksum  string    `json:"localChecksum"`
+	LocalModTime   time.Time `json:"localModTime"`
+	RemoteChecksum string    `json:"remoteChecksum"`
+	RemoteModTime  time.Time `json:"remoteModTime"`
+}
+
+func loadBisyncState() (map[string]map[string]bisyncBaseline, error) {
+	state := map[string]map[string]bisyncBaseline{}
+	bx, err := os.ReadFile(bisyncStateFilePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read bisync state: %v", err)
+	}
+	if err := json.Unmarshal(bx, &state); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal bisync state: %v", err)
+	}
+	return state, nil
+}
+
+func saveBisyncState(state map[string]map[string]bisyncBaseline) error {
+	bx, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal bisync state: %v", err)
+	}
+	if err := os.WriteFile(bisyncStateFilePath, bx, 0644); err != nil {
+		return fmt.Errorf("unable to write bisync state: %v", err)
+	}
+	return nil
+}
+
+func loadBisyncBaseline(mappingKey string) (map[string]bisyncBaseline, error) {
+	bisyncStateMu.Lock()
+	defer bisyncStateMu.Unlock()
+
+	state, err := loadBisyncState()
+	if err != nil {
+		return nil, err
+	}
+	return state[mappingKey], nil
+}
+
+func saveBisyncBaseline(mappingKey string, baseline map[string]bisyncBaseline) error {
+	bisyncStateMu.Lock()
+	defer bisyncStateMu.Unlock()
+
+	state, err := loadBisyncState()
+	if err != nil {
+		return err
+	}
+	state[mappingKey] = baseline
+	return saveBisyncState(state)
+}
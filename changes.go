@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const syncStateFilePath = ".cloudsyncer-state.json"
+
+// syncStateMu serializes every load-mutate-save round trip against
+// syncStateFilePath. main() syncs every mapped directory in its own
+// goroutine, and each owns a different top-level key in an otherwise-shared
+// file, so without this the loser of two concurrent saves would silently
+// drop the winner's folder state.
+var syncStateMu sync.Mutex
+
+// folderSyncState is the persisted incremental-sync bookkeeping for one
+// mapped remote folder: the Changes API token to resume from, the last
+// known snapshot of files under that folder, and the folder ID -> relative
+// path index needed to place a changed file without re-walking the tree.
+// This is driveBackend-internal; other backends don't keep this kind of
+// state (see bisync_state.go for the backend-agnostic bisync baseline).
+type folderSyncState struct {
+	StartPageToken string                 `json:"startPageToken"`
+	Snapshot       map[string]*drive.File `json:"snapshot"`
+	FolderPaths    map[string]string      `json:"folderPaths"`
+}
+
+func loadSyncState() (map[string]folderSyncState, error) {
+	state := map[string]folderSyncState{}
+	bx, err := os.ReadFile(syncStateFilePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sync state: %v", err)
+	}
+	if err := json.Unmarshal(bx, &state); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal sync state: %v", err)
+	}
+	return state, nil
+}
+
+func saveSyncState(state map[string]folderSyncState) error {
+	bx, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal sync state: %v", err)
+	}
+	if err := os.WriteFile(syncStateFilePath, bx, 0644); err != nil {
+		return fmt.Errorf("unable to write sync state: %v", err)
+	}
+	return nil
+}
+
+// loadSyncStateEntry returns remoteFolderID's persisted state, under
+// syncStateMu so it can't observe a half-written save from another mapped
+// directory's goroutine.
+func loadSyncStateEntry(remoteFolderID string) (folderSyncState, bool, error) {
+	syncStateMu.Lock()
+	defer syncStateMu.Unlock()
+
+	state, err := loadSyncState()
+	if err != nil {
+		return folderSyncState{}, false, err
+	}
+	fs, known := state[remoteFolderID]
+	return fs, known, nil
+}
+
+// saveSyncStateEntry atomically updates just remoteFolderID's entry: it
+// reloads fresh state under syncStateMu immediately before writing, so a
+// concurrent directory's save can't be clobbered by this one carrying a
+// stale snapshot of the rest of the file.
+func saveSyncStateEntry(remoteFolderID string, entry folderSyncState) error {
+	syncStateMu.Lock()
+	defer syncStateMu.Unlock()
+
+	state, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+	state[remoteFolderID] = entry
+	return saveSyncState(state)
+}
+
+func getStartPageToken(srv *drive.Service, p *pacer) (string, error) {
+	var token string
+	err := p.call(func() error {
+		result, callErr := srv.Changes.GetStartPageToken().Do()
+		if callErr != nil {
+			return callErr
+		}
+		token = result.StartPageToken
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to get start page token: %v", err)
+	}
+	return token, nil
+}
+
+// fetchRemoteFilesIncremental returns the current remote file set for
+// remoteFolderID, either by asking the Changes API for what moved since the
+// last run or, on first run / --full-scan / an expired token, by doing the
+// full recursive listing and capturing a fresh token to resume from next
+// time.
+func fetchRemoteFilesIncremental(remoteFolderID string, srv *drive.Service, p *pacer, fullScan bool) (map[string]*drive.File, error) {
+	fs, known, err := loadSyncStateEntry(remoteFolderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if fullScan || !known || fs.StartPageToken == "" {
+		return fullRemoteScan(remoteFolderID, srv, p)
+	}
+
+	remoteFiles := make(map[string]*drive.File, len(fs.Snapshot))
+	for path, file := range fs.Snapshot {
+		remoteFiles[path] = file
+	}
+	folderPaths := make(map[string]string, len(fs.FolderPaths)+1)
+	for id, path := range fs.FolderPaths {
+		folderPaths[id] = path
+	}
+	folderPaths[remoteFolderID] = ""
+
+	idToPath := make(map[string]string, len(remoteFiles))
+	for path, file := range remoteFiles {
+		idToPath[file.Id] = path
+	}
+
+	pageToken := fs.StartPageToken
+	for pageToken != "" {
+		var result *drive.ChangeList
+		err := p.call(func() error {
+			var callErr error
+			result, callErr = srv.Changes.List(pageToken).
+				IncludeRemoved(true).
+				Fields("nextPageToken, newStartPageToken, changes(fileId, removed, file(id, name, md5Checksum, mimeType, parents, trashed, modifiedTime, size))").
+				Do()
+			return callErr
+		})
+		if err != nil {
+			// The token is most likely stale (expired/invalid); fall back
+			// to a full listing rather than fail the whole sync.
+			fmt.Printf("Incremental token invalid for %s, falling back to full scan: %v\n", remoteFolderID, err)
+			return fullRemoteScan(remoteFolderID, srv, p)
+		}
+
+		for _, change := range result.Changes {
+			applyChange(change, remoteFolderID, remoteFiles, folderPaths, idToPath, srv, p)
+		}
+
+		if result.NewStartPageToken != "" {
+			fs.StartPageToken = result.NewStartPageToken
+		}
+		pageToken = result.NextPageToken
+	}
+
+	if err := saveSyncStateEntry(remoteFolderID, folderSyncState{
+		StartPageToken: fs.StartPageToken,
+		Snapshot:       remoteFiles,
+		FolderPaths:    folderPaths,
+	}); err != nil {
+		return nil, err
+	}
+
+	return remoteFiles, nil
+}
+
+// fetchRemoteFilesFull does a full recursive listing of parentID, populating
+// remoteFiles with every non-folder file (keyed by its path relative to the
+// mapped folder) and folderPaths with every folder's relative path (keyed by
+// folder ID), the latter needed so incremental syncs can resolve a changed
+// file's path without re-walking the whole tree.
+func fetchRemoteFilesFull(parentID, path string, remoteFiles map[string]*drive.File, folderPaths map[string]string, srv *drive.Service, p *pacer) error {
+	pageToken := ""
+	for {
+		query := fmt.Sprintf("'%s' in parents and trashed=false", parentID)
+
+		var result *drive.FileList
+		err := p.call(func() error {
+			var callErr error
+			result, callErr = srv.Files.List().Q(query).Fields("nextPageToken, files(id, name, md5Checksum, mimeType, parents, modifiedTime, size)").PageToken(pageToken).Do()
+			return callErr
+		})
+		if err != nil {
+			return fmt.Errorf("unable to list files: %v", err)
+		}
+
+		for _, file := range result.Files {
+			remotePath := filepath.Join(path, file.Name)
+			if file.MimeType == "application/vnd.google-apps.folder" {
+				folderPaths[file.Id] = remotePath
+				if err := fetchRemoteFilesFull(file.Id, remotePath, remoteFiles, folderPaths, srv, p); err != nil {
+					return err
+				}
+			} else {
+				remoteFiles[remotePath] = file
+			}
+		}
+
+		if result.NextPageToken == "" {
+			break
+		}
+		pageToken = result.NextPageToken
+	}
+	return nil
+}
+
+func fullRemoteScan(remoteFolderID string, srv *drive.Service, p *pacer) (map[string]*drive.File, error) {
+	remoteFiles := make(map[string]*drive.File)
+	folderPaths := map[string]string{remoteFolderID: ""}
+	if err := fetchRemoteFilesFull(remoteFolderID, "", remoteFiles, folderPaths, srv, p); err != nil {
+		return nil, err
+	}
+
+	token, err := getStartPageToken(srv, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveSyncStateEntry(remoteFolderID, folderSyncState{
+		StartPageToken: token,
+		Snapshot:       remoteFiles,
+		FolderPaths:    folderPaths,
+	}); err != nil {
+		return nil, err
+	}
+
+	return remoteFiles, nil
+}
+
+// applyChange folds a single Changes API entry into the in-memory index.
+// Changes outside remoteFolderID's tree (or for files the tree never knew
+// about) are ignored rather than erroring, since the Changes API reports
+// changes account-wide.
+func applyChange(change *drive.Change, remoteFolderID string, remoteFiles map[string]*drive.File, folderPaths, idToPath map[string]string, srv *drive.Service, p *pacer) {
+	if change.Removed || change.File == nil || change.File.Trashed {
+		if path, ok := idToPath[change.FileId]; ok {
+			delete(remoteFiles, path)
+			delete(idToPath, change.FileId)
+		}
+		delete(folderPaths, change.FileId)
+		return
+	}
+
+	file := change.File
+
+	if file.MimeType == "application/vnd.google-apps.folder" {
+		path, ok := resolveParentPath(file.Parents, remoteFolderID, folderPaths, srv, p)
+		if !ok {
+			return
+		}
+		folderPaths[file.Id] = filepath.Join(path, file.Name)
+		return
+	}
+
+	path, ok := resolveParentPath(file.Parents, remoteFolderID, folderPaths, srv, p)
+	if !ok {
+		return
+	}
+	remotePath := filepath.Join(path, file.Name)
+
+	if oldPath, existed := idToPath[file.Id]; existed && oldPath != remotePath {
+		delete(remoteFiles, oldPath)
+	}
+	remoteFiles[remotePath] = file
+	idToPath[file.Id] = remotePath
+}
+
+// resolveParentPath returns the relative path of the first parent folder
+// that's part of remoteFolderID's tree, walking up via Files.Get when a
+// parent isn't already indexed (e.g. a newly created nested folder) and
+// memoizing the result into folderPaths.
+func resolveParentPath(parents []string, remoteFolderID string, folderPaths map[string]string, srv *drive.Service, p *pacer) (string, bool) {
+	for _, parentID := range parents {
+		if path, ok := folderPaths[parentID]; ok {
+			return path, true
+		}
+	}
+
+	for _, parentID := range parents {
+		if path, ok := climbToKnownFolder(parentID, remoteFolderID, folderPaths, srv, p); ok {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+func climbToKnownFolder(folderID, remoteFolderID string, folderPaths map[string]string, srv *drive.Service, p *pacer) (string, bool) {
+	var chain []*drive.File
+
+	currentID := folderID
+	for {
+		if path, ok := folderPaths[currentID]; ok {
+			for i := len(chain) - 1; i >= 0; i-- {
+				path = filepath.Join(path, chain[i].Name)
+				folderPaths[chain[i].Id] = path
+			}
+			return path, true
+		}
+
+		var folder *drive.File
+		err := p.call(func() error {
+			var callErr error
+			folder, callErr = srv.Files.Get(currentID).Fields("id, name, parents").Do()
+			return callErr
+		})
+		if err != nil || folder == nil || len(folder.Parents) == 0 {
+			return "", false
+		}
+
+		chain = append(chain, folder)
+		currentID = folder.Parents[0]
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// driveBackend is the Backend implementation backing the original
+// Google Drive support: resumable uploads, the pacer, and incremental
+// listing via the Changes API (changes.go) all live behind it.
+type driveBackend struct {
+	folderID      string
+	srv           *drive.Service
+	httpClient    *http.Client
+	p             *pacer
+	opts          *syncOptions
+	folderCache   map[string]string
+	folderCacheMu sync.Mutex
+	// folderLocks holds one mutex per not-yet-resolved cache key, so two
+	// goroutines racing to create the same new subfolder serialize onto the
+	// check-then-create Drive round trip instead of each running it and
+	// leaving a duplicate folder behind. See resolveFolder.
+	folderLocks map[string]*sync.Mutex
+}
+
+func newDriveBackend(folderID string, srv *drive.Service, httpClient *http.Client, p *pacer, opts *syncOptions) *driveBackend {
+	return &driveBackend{
+		folderID:    folderID,
+		srv:         srv,
+		httpClient:  httpClient,
+		p:           p,
+		opts:        opts,
+		folderCache: make(map[string]string),
+		folderLocks: make(map[string]*sync.Mutex),
+	}
+}
+
+func (b *driveBackend) List(fullScan bool) (map[string]RemoteFile, error) {
+	files, err := fetchRemoteFilesIncremental(b.folderID, b.srv, b.p, fullScan)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteFiles := make(map[string]RemoteFile, len(files))
+	for path, file := range files {
+		remoteFiles[path] = driveFileToRemote(file, path)
+	}
+	return remoteFiles, nil
+}
+
+func driveFileToRemote(file *drive.File, path string) RemoteFile {
+	modTime, _ := time.Parse(time.RFC3339, file.ModifiedTime)
+	return RemoteFile{ID: file.Id, Path: path, Hash: file.Md5Checksum, ModTime: modTime, Size: file.Size}
+}
+
+func (b *driveBackend) Upload(localPath, relativePath string) (RemoteFile, error) {
+	parentID, err := b.mkdirChain(filepath.Dir(relativePath))
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("unable to create or get folder for %s: %v", relativePath, err)
+	}
+
+	checksum, err := computeMD5(localPath)
+	if err != nil {
+		return RemoteFile{}, err
+	}
+
+	url := driveUploadURL + "?uploadType=resumable"
+	metadata := mustJSON(&drive.File{
+		Name:    filepath.Base(relativePath),
+		Parents: []string{parentID},
+	})
+
+	result, err := resumableUpload(b.httpClient, http.MethodPost, url, metadata, localPath, uploadStateKey(relativePath, checksum), b.opts.ChunkSize, b.p)
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("unable to upload file: %v", err)
+	}
+
+	fmt.Printf("Uploaded: %s\n", localPath)
+	return driveFileToRemote(result, relativePath), nil
+}
+
+func (b *driveBackend) Update(localPath, relativePath string, remote RemoteFile) (RemoteFile, error) {
+	checksum, err := computeMD5(localPath)
+	if err != nil {
+		return RemoteFile{}, err
+	}
+
+	url := fmt.Sprintf(driveUploadURLForOne, remote.ID) + "?uploadType=resumable"
+	metadata := mustJSON(struct{}{})
+
+	result, err := resumableUpload(b.httpClient, http.MethodPatch, url, metadata, localPath, uploadStateKey(relativePath, checksum), b.opts.ChunkSize, b.p)
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("unable to update file: %v", err)
+	}
+
+	fmt.Printf("Updated: %s\n", localPath)
+	return driveFileToRemote(result, relativePath), nil
+}
+
+func (b *driveBackend) Download(remote RemoteFile, destPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("unable to create local directory for %s: %v", destPath, err)
+	}
+
+	var resp *http.Response
+	err := b.p.call(func() error {
+		var callErr error
+		resp, callErr = b.srv.Files.Get(remote.ID).Download()
+		return callErr
+	})
+	if err != nil {
+		return fmt.Errorf("unable to download file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	out, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("unable to create local file: %v", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("unable to write local file: %v", err)
+	}
+	return nil
+}
+
+func (b *driveBackend) Delete(remote RemoteFile) error {
+	return b.p.call(func() error { return b.srv.Files.Delete(remote.ID).Do() })
+}
+
+// Rename preserves remote's current content under newName via Files.Copy
+// rather than downloading and re-uploading the bytes; Drive places the copy
+// alongside the original when no parent is given.
+func (b *driveBackend) Rename(remote RemoteFile, newName string) error {
+	return b.p.call(func() error {
+		_, err := b.srv.Files.Copy(remote.ID, &drive.File{Name: newName}).Do()
+		return err
+	})
+}
+
+func (b *driveBackend) Hash() HashType {
+	return HashMD5
+}
+
+// mkdirChain resolves (creating as needed) the folder chain for dirPath
+// relative to b.folderID, returning the innermost folder's ID. "." (a file
+// directly under the mapped root) is a no-op.
+func (b *driveBackend) mkdirChain(dirPath string) (string, error) {
+	parentID := b.folderID
+	if dirPath == "." || dirPath == "" {
+		return parentID, nil
+	}
+
+	parts := strings.Split(filepath.ToSlash(dirPath), "/")
+	for i, part := range parts {
+		cacheKey := strings.Join(parts[:i+1], "/")
+
+		var err error
+		parentID, err = b.resolveFolder(cacheKey, part, parentID)
+		if err != nil {
+			return "", fmt.Errorf("unable to create or get folder '%s': %v", cacheKey, err)
+		}
+	}
+
+	return parentID, nil
+}
+
+// resolveFolder returns cacheKey's folder ID under parentID, creating it on
+// Drive if needed. The worker pool (chunk0-2) can have several goroutines
+// racing to resolve the same brand-new subfolder concurrently; a per-key
+// lock makes the whole check-cache -> query-Drive -> create-if-missing
+// sequence atomic per key, so only one of them ever runs
+// createOrGetFolder for it instead of each creating a duplicate.
+func (b *driveBackend) resolveFolder(cacheKey, folderName, parentID string) (string, error) {
+	b.folderCacheMu.Lock()
+	if id, ok := b.folderCache[cacheKey]; ok {
+		b.folderCacheMu.Unlock()
+		return id, nil
+	}
+	keyMu, ok := b.folderLocks[cacheKey]
+	if !ok {
+		keyMu = &sync.Mutex{}
+		b.folderLocks[cacheKey] = keyMu
+	}
+	b.folderCacheMu.Unlock()
+
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	// Re-check: whoever held keyMu before us may have just resolved it.
+	b.folderCacheMu.Lock()
+	if id, ok := b.folderCache[cacheKey]; ok {
+		b.folderCacheMu.Unlock()
+		return id, nil
+	}
+	b.folderCacheMu.Unlock()
+
+	id, err := createOrGetFolder(folderName, parentID, b.srv, b.p)
+	if err != nil {
+		return "", err
+	}
+
+	b.folderCacheMu.Lock()
+	b.folderCache[cacheKey] = id
+	b.folderCacheMu.Unlock()
+
+	return id, nil
+}
+
+// createOrGetFolder is only reached via mkdirChain from Upload, and the
+// push/bisync callers that drive Upload already short-circuit on
+// opts.DryRun before ever calling it, so it always runs for real.
+func createOrGetFolder(folderName, parentID string, srv *drive.Service, p *pacer) (string, error) {
+	query := fmt.Sprintf("name='%s' and '%s' in parents and mimeType='application/vnd.google-apps.folder' and trashed=false", folderName, parentID)
+
+	var result *drive.FileList
+	err := p.call(func() error {
+		var callErr error
+		result, callErr = srv.Files.List().Q(query).Fields("files(id)").Do()
+		return callErr
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to query folders: %v", err)
+	}
+
+	if len(result.Files) > 0 {
+		return result.Files[0].Id, nil
+	}
+
+	folder := &drive.File{
+		Name:     folderName,
+		MimeType: "application/vnd.google-apps.folder",
+		Parents:  []string{parentID},
+	}
+
+	var createdFolder *drive.File
+	err = p.call(func() error {
+		var callErr error
+		createdFolder, callErr = srv.Files.Create(folder).Do()
+		return callErr
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create folder: %v", err)
+	}
+
+	return createdFolder.Id, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// fileBackend treats a local directory as the "remote" side, useful both
+// for testing sync logic without Drive credentials and for syncing between
+// two local/mounted trees. It has no MD5 equivalent to Drive's, so it
+// hashes with SHA-256 instead.
+type fileBackend struct {
+	root string
+}
+
+func newFileBackend(root string) *fileBackend {
+	return &fileBackend{root: root}
+}
+
+func (b *fileBackend) List(fullScan bool) (map[string]RemoteFile, error) {
+	files := make(map[string]RemoteFile)
+
+	err := filepath.Walk(b.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == b.root {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return fmt.Errorf("failed to compute relative path: %v", err)
+		}
+
+		hash, err := computeSHA256(path)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %v", path, err)
+		}
+
+		files[relativePath] = RemoteFile{ID: relativePath, Path: relativePath, Hash: hash, ModTime: info.ModTime(), Size: info.Size()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %s: %v", b.root, err)
+	}
+
+	return files, nil
+}
+
+func (b *fileBackend) Upload(localPath, relativePath string) (RemoteFile, error) {
+	destPath := filepath.Join(b.root, relativePath)
+	if err := copyFile(localPath, destPath); err != nil {
+		return RemoteFile{}, fmt.Errorf("unable to copy %s to %s: %v", localPath, destPath, err)
+	}
+	fmt.Printf("Uploaded: %s\n", localPath)
+	return b.stat(relativePath)
+}
+
+func (b *fileBackend) Update(localPath, relativePath string, remote RemoteFile) (RemoteFile, error) {
+	destPath := filepath.Join(b.root, relativePath)
+	if err := copyFile(localPath, destPath); err != nil {
+		return RemoteFile{}, fmt.Errorf("unable to copy %s to %s: %v", localPath, destPath, err)
+	}
+	fmt.Printf("Updated: %s\n", localPath)
+	return b.stat(relativePath)
+}
+
+func (b *fileBackend) Download(remote RemoteFile, destPath string) error {
+	return copyFile(filepath.Join(b.root, remote.Path), destPath)
+}
+
+func (b *fileBackend) Delete(remote RemoteFile) error {
+	return os.Remove(filepath.Join(b.root, remote.Path))
+}
+
+func (b *fileBackend) Rename(remote RemoteFile, newName string) error {
+	oldPath := filepath.Join(b.root, remote.Path)
+	newPath := filepath.Join(filepath.Dir(oldPath), newName)
+	return os.Rename(oldPath, newPath)
+}
+
+func (b *fileBackend) Hash() HashType {
+	return HashSHA256
+}
+
+func (b *fileBackend) stat(relativePath string) (RemoteFile, error) {
+	path := filepath.Join(b.root, relativePath)
+	info, err := os.Stat(path)
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("unable to stat %s: %v", path, err)
+	}
+	hash, err := computeSHA256(path)
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("unable to hash %s: %v", path, err)
+	}
+	return RemoteFile{ID: relativePath, Path: relativePath, Hash: hash, ModTime: info.ModTime(), Size: info.Size()}, nil
+}
+
+func copyFile(srcPath, destPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("unable to create directory: %v", err)
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("unable to open source file: %v", err)
+	}
+	defer src.Close()
+
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("unable to create destination file: %v", err)
+	}
+	defer dest.Close()
+
+	if _, err := io.Copy(dest, src); err != nil {
+		return fmt.Errorf("unable to copy contents: %v", err)
+	}
+	return nil
+}
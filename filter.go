@@ -0,0 +1,213 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const ignoreFileName = ".cloudsyncerignore"
+
+// syncFilters governs which paths participate in a sync. Whatever it rules
+// out is skipped on the upload/download side and, symmetrically, never
+// considered a delete candidate on the other side either — narrowing what's
+// synced can never turn into the delete phase nuking the content it skipped.
+type syncFilters struct {
+	Include          []string
+	Exclude          []string
+	MaxSize          int64
+	MinSize          int64
+	ExcludeIfPresent string
+
+	ignoreMu    sync.Mutex
+	ignoreCache map[string][]ignoreRule
+}
+
+// excluded reports whether relPath (size bytes, rooted at localDir) should
+// be left out of the sync. It's the single predicate used for both the
+// upload-side walk and the delete-phase check, so the two always agree.
+func (f *syncFilters) excluded(localDir, relPath string, size int64) bool {
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return true
+	}
+	if f.MinSize > 0 && size < f.MinSize {
+		return true
+	}
+	if len(f.Include) > 0 && !matchesAny(f.Include, relPath) {
+		return true
+	}
+	if matchesAny(f.Exclude, relPath) {
+		return true
+	}
+	if f.markerAncestorExcluded(localDir, relPath) {
+		return true
+	}
+	// A directory pruned by dirExcluded takes everything under it along.
+	for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+		if f.ignoredByRules(localDir, dir, true) {
+			return true
+		}
+	}
+	return f.ignoredByRules(localDir, relPath, false)
+}
+
+// dirExcluded reports whether relDir itself should be pruned entirely
+// (filepath.Walk's SkipDir) rather than descended into.
+func (f *syncFilters) dirExcluded(localDir, relDir string) bool {
+	if f.ExcludeIfPresent != "" {
+		if _, err := os.Stat(filepath.Join(localDir, relDir, f.ExcludeIfPresent)); err == nil {
+			return true
+		}
+	}
+	return f.ignoredByRules(localDir, relDir, true)
+}
+
+func matchesAny(patterns []string, relPath string) bool {
+	slashPath := filepath.ToSlash(relPath)
+	base := filepath.Base(slashPath)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, slashPath); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// markerAncestorExcluded reports whether relPath's marker (--exclude-if-present)
+// shows up in relPath's own directory or any ancestor of it, up to localDir.
+func (f *syncFilters) markerAncestorExcluded(localDir, relPath string) bool {
+	if f.ExcludeIfPresent == "" {
+		return false
+	}
+
+	dir := filepath.Dir(relPath)
+	for {
+		if _, err := os.Stat(filepath.Join(localDir, dir, f.ExcludeIfPresent)); err == nil {
+			return true
+		}
+		if dir == "." {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// ignoredByRules applies every .cloudsyncerignore from localDir down to
+// relPath's directory, root first, so a deeper rule can override a
+// shallower one the way gitignore's cascading does.
+func (f *syncFilters) ignoredByRules(localDir, relPath string, isDir bool) bool {
+	var chain []string
+	for dir := filepath.Dir(relPath); ; dir = filepath.Dir(dir) {
+		chain = append([]string{dir}, chain...)
+		if dir == "." {
+			break
+		}
+	}
+
+	ignored := false
+	for _, ancestorRel := range chain {
+		ancestorDir := localDir
+		if ancestorRel != "." {
+			ancestorDir = filepath.Join(localDir, ancestorRel)
+		}
+
+		rel, err := filepath.Rel(ancestorDir, filepath.Join(localDir, relPath))
+		if err != nil {
+			continue
+		}
+
+		for _, rule := range f.loadIgnoreRules(ancestorDir) {
+			if rule.matches(filepath.ToSlash(rel), isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+func (f *syncFilters) loadIgnoreRules(dirPath string) []ignoreRule {
+	f.ignoreMu.Lock()
+	defer f.ignoreMu.Unlock()
+
+	if f.ignoreCache == nil {
+		f.ignoreCache = make(map[string][]ignoreRule)
+	}
+	if rules, ok := f.ignoreCache[dirPath]; ok {
+		return rules
+	}
+
+	rules := parseIgnoreFile(filepath.Join(dirPath, ignoreFileName))
+	f.ignoreCache[dirPath] = rules
+	return rules
+}
+
+// ignoreRule is one line of a .cloudsyncerignore file: a gitignore-style
+// glob, optionally negated ("!pattern"), anchored to its directory
+// ("/pattern"), or restricted to directories ("pattern/").
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	anchored bool
+	dirOnly  bool
+}
+
+func parseIgnoreFile(path string) []ignoreRule {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var rules []ignoreRule
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(strings.TrimRight(line, "\r"))
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		rule := ignoreRule{}
+		if strings.HasPrefix(trimmed, "!") {
+			rule.negate = true
+			trimmed = trimmed[1:]
+		}
+		if strings.HasSuffix(trimmed, "/") {
+			rule.dirOnly = true
+			trimmed = strings.TrimSuffix(trimmed, "/")
+		}
+		if strings.HasPrefix(trimmed, "/") {
+			rule.anchored = true
+			trimmed = strings.TrimPrefix(trimmed, "/")
+		}
+
+		rule.pattern = trimmed
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matches tests relPath (slash-separated, relative to the directory holding
+// this rule's .cloudsyncerignore) against the rule. An anchored pattern must
+// match the whole relative path; an unanchored one may match at any depth,
+// mirroring gitignore.
+func (r ignoreRule) matches(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.anchored {
+		ok, _ := filepath.Match(r.pattern, relPath)
+		return ok
+	}
+
+	segments := strings.Split(relPath, "/")
+	for i := range segments {
+		if ok, _ := filepath.Match(r.pattern, strings.Join(segments[i:], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
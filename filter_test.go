@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreRuleMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    ignoreRule
+		relPath string
+		isDir   bool
+		want    bool
+	}{
+		{"unanchored matches at top level", ignoreRule{pattern: "*.log"}, "debug.log", false, true},
+		{"unanchored matches at any depth", ignoreRule{pattern: "*.log"}, "logs/debug.log", false, true},
+		{"unanchored no match", ignoreRule{pattern: "*.log"}, "debug.txt", false, false},
+		{"anchored only matches full path", ignoreRule{pattern: "build/*.log", anchored: true}, "build/debug.log", false, true},
+		{"anchored does not match nested", ignoreRule{pattern: "*.log", anchored: true}, "logs/debug.log", false, false},
+		{"dirOnly skips files", ignoreRule{pattern: "node_modules", dirOnly: true}, "node_modules", false, false},
+		{"dirOnly matches directories", ignoreRule{pattern: "node_modules", dirOnly: true}, "node_modules", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matches(tt.relPath, tt.isDir); got != tt.want {
+				t.Errorf("matches(%q, isDir=%v) = %v, want %v", tt.relPath, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesAny(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		relPath  string
+		want     bool
+	}{
+		{"no patterns", nil, "a.txt", false},
+		{"matches base name", []string{"*.txt"}, "dir/sub/a.txt", true},
+		{"matches full relative path", []string{"dir/sub/*.txt"}, "dir/sub/a.txt", true},
+		{"no match", []string{"*.jpg"}, "dir/sub/a.txt", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesAny(tt.patterns, tt.relPath); got != tt.want {
+				t.Errorf("matchesAny(%v, %q) = %v, want %v", tt.patterns, tt.relPath, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncFiltersExcludedIgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "build"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, ignoreFileName), []byte("*.log\n!keep.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &syncFilters{}
+
+	if !f.excluded(root, "debug.log", 10) {
+		t.Error("expected debug.log to be excluded by root .cloudsyncerignore")
+	}
+	if !f.excluded(root, "build/debug.log", 10) {
+		t.Error("expected build/debug.log to be excluded (unanchored pattern matches any depth)")
+	}
+	if f.excluded(root, "keep.log", 10) {
+		t.Error("expected keep.log to survive the negated rule")
+	}
+	if f.excluded(root, "main.go", 10) {
+		t.Error("expected main.go not to be excluded")
+	}
+}
+
+func TestSyncFiltersExcludedIncludeExcludeAndSize(t *testing.T) {
+	root := t.TempDir()
+	f := &syncFilters{
+		Include: []string{"*.go"},
+		Exclude: []string{"*_generated.go"},
+		MaxSize: 100,
+		MinSize: 10,
+	}
+
+	if f.excluded(root, "main.go", 50) {
+		t.Error("main.go matches Include and is within size bounds, should not be excluded")
+	}
+	if !f.excluded(root, "main.txt", 50) {
+		t.Error("main.txt doesn't match Include, should be excluded")
+	}
+	if !f.excluded(root, "api_generated.go", 50) {
+		t.Error("api_generated.go matches Exclude, should be excluded despite matching Include")
+	}
+	if !f.excluded(root, "main.go", 5) {
+		t.Error("file smaller than MinSize should be excluded")
+	}
+	if !f.excluded(root, "main.go", 200) {
+		t.Error("file larger than MaxSize should be excluded")
+	}
+}
+
+func TestSyncFiltersExcludeIfPresentAncestor(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "project", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "project", ".nosync"), []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &syncFilters{ExcludeIfPresent: ".nosync"}
+
+	if !f.excluded(root, "project/sub/file.txt", 10) {
+		t.Error("expected file.txt to be excluded: marker is present in an ancestor directory")
+	}
+	if !f.dirExcluded(root, "project") {
+		t.Error("expected project directory itself to be pruned: it holds the marker")
+	}
+	if f.excluded(root, "other/file.txt", 10) {
+		t.Error("expected other/file.txt not to be excluded: no marker in its ancestry")
+	}
+}
@@ -2,255 +2,194 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
+	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 const inputFolderMapPath = "dir_map.json"
 const credFilePath = "service-account.json"
 
-func main() {
-	localServerDirMap := map[string]string{}
+// syncOptions bundles the flags that shape how a directory is synced, kept
+// together because the Backend implementations and the mode implementations
+// in sync_mode.go all need most of them.
+type syncOptions struct {
+	ChunkSize int
+	Transfers int
+	FullScan  bool
+	Mode      syncMode
+	Conflict  conflictPolicy
+	DryRun    bool
+	Filters   *syncFilters
+}
 
-	bx, err := os.ReadFile(inputFolderMapPath)
-	if err != nil {
-		fmt.Printf("Error reading input folder map: %v\n", err)
-		os.Exit(1)
-	}
+// stringListFlag collects repeatable string flags like --include/--exclude
+// into a slice.
+type stringListFlag []string
 
-	if err := json.Unmarshal(bx, &localServerDirMap); err != nil {
-		fmt.Printf("Error unmarshaling input folder map: %v\n", err)
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func main() {
+	chunkSizeFlag := flag.Int("chunk-size", defaultChunkSize, "upload chunk size in bytes (min 256KiB, must be a multiple of 256KiB)")
+	transfersFlag := flag.Int("transfers", 4, "maximum number of concurrent uploads/updates per synced directory")
+	fullScanFlag := flag.Bool("full-scan", false, "ignore the persisted change token and do a full recursive remote listing")
+	modeFlag := flag.String("mode", "push", "sync direction: push (local to remote), pull (remote to local), or bisync (both ways)")
+	conflictFlag := flag.String("conflict", "newer", "bisync conflict policy: newer, larger, local, remote, or rename")
+	dryRunFlag := flag.Bool("dry-run", false, "log planned uploads/updates/deletes without changing anything")
+	var includeFlag, excludeFlag stringListFlag
+	flag.Var(&includeFlag, "include", "glob a file must match to be synced (repeatable)")
+	flag.Var(&excludeFlag, "exclude", "glob that excludes a file from being synced (repeatable)")
+	maxSizeFlag := flag.Int64("max-size", 0, "skip files larger than this many bytes (0 = no limit)")
+	minSizeFlag := flag.Int64("min-size", 0, "skip files smaller than this many bytes (0 = no limit)")
+	excludeIfPresentFlag := flag.String("exclude-if-present", "", "skip a directory tree if this marker file exists in it")
+	flag.Parse()
+
+	mode, err := parseSyncMode(*modeFlag)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
-
-	srv, err := getDriveService()
+	conflict, err := parseConflictPolicy(*conflictFlag)
 	if err != nil {
-		fmt.Printf("Error creating Drive service: %v\n", err)
+		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	var wg sync.WaitGroup
+	transfers := *transfersFlag
+	if transfers < 1 {
+		transfers = 1
+	}
 
-	for localDir, remoteFolderID := range localServerDirMap {
-		wg.Add(1)
-		go func(localDir, remoteFolderID string) {
-			defer wg.Done()
-			fmt.Printf("Syncing %s with folder ID %s\n", localDir, remoteFolderID)
-			if err := syncFiles(localDir, remoteFolderID, srv); err != nil {
-				fmt.Printf("Error syncing files for %s: %v\n", localDir, err)
-			}
-		}(localDir, remoteFolderID)
+	opts := &syncOptions{
+		ChunkSize: normalizeChunkSize(*chunkSizeFlag),
+		Transfers: transfers,
+		FullScan:  *fullScanFlag,
+		Mode:      mode,
+		Conflict:  conflict,
+		DryRun:    *dryRunFlag,
+		Filters: &syncFilters{
+			Include:          includeFlag,
+			Exclude:          excludeFlag,
+			MaxSize:          *maxSizeFlag,
+			MinSize:          *minSizeFlag,
+			ExcludeIfPresent: *excludeIfPresentFlag,
+		},
 	}
 
-	wg.Wait()
-	fmt.Println("Sync completed successfully!")
-}
+	p := newPacer(pacerMinSleep, pacerMaxSleep)
 
-func getDriveService() (*drive.Service, error) {
-	ctx := context.Background()
-	srv, err := drive.NewService(ctx, option.WithCredentialsFile(credFilePath))
+	localServerDirMap := map[string]string{}
+
+	bx, err := os.ReadFile(inputFolderMapPath)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create Drive service: %v", err)
+		fmt.Printf("Error reading input folder map: %v\n", err)
+		os.Exit(1)
 	}
-	return srv, nil
-}
 
-func syncFiles(localDir, remoteFolderID string, srv *drive.Service) error {
-	remoteFiles := make(map[string]*drive.File)
-	folderCache := make(map[string]string) // Cache for created folders
-	if err := fetchRemoteFiles(remoteFolderID, "", remoteFiles, srv); err != nil {
-		return fmt.Errorf("failed to fetch remote files: %v", err)
+	if err := json.Unmarshal(bx, &localServerDirMap); err != nil {
+		fmt.Printf("Error unmarshaling input folder map: %v\n", err)
+		os.Exit(1)
 	}
 
-	localFiles := make(map[string]string)
-	if err := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+	specs := make(map[string]backendSpec, len(localServerDirMap))
+	needsDrive := false
+	for localDir, raw := range localServerDirMap {
+		spec, err := parseBackendSpec(raw)
 		if err != nil {
-			return err
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
 		}
-
-		if info.IsDir() {
-			return nil
+		specs[localDir] = spec
+		if spec.Scheme == "gdrive" {
+			needsDrive = true
 		}
-
-		relativePath, err := filepath.Rel(localDir, path)
-		if err != nil {
-			return fmt.Errorf("failed to compute relative path: %v", err)
-		}
-
-		checksum, err := computeMD5(path)
-		if err != nil {
-			return fmt.Errorf("failed to compute checksum for %s: %v", path, err)
-		}
-
-		localFiles[relativePath] = checksum
-		return uploadOrUpdateFile(path, relativePath, checksum, remoteFiles, remoteFolderID, folderCache, srv)
-	}); err != nil {
-		return err
-	}
-
-	if err := deleteRemoteFiles(localFiles, remoteFiles, srv); err != nil {
-		return fmt.Errorf("failed to delete remote files: %v", err)
 	}
 
-	return nil
-}
-
-func fetchRemoteFiles(parentID, path string, remoteFiles map[string]*drive.File, srv *drive.Service) error {
-	pageToken := ""
-	for {
-		query := fmt.Sprintf("'%s' in parents and trashed=false", parentID)
-		result, err := srv.Files.List().Q(query).Fields("nextPageToken, files(id, name, md5Checksum, mimeType)").PageToken(pageToken).Do()
+	var srv *drive.Service
+	var httpClient *http.Client
+	if needsDrive {
+		srv, httpClient, err = getDriveService()
 		if err != nil {
-			return fmt.Errorf("unable to list files: %v", err)
+			fmt.Printf("Error creating Drive service: %v\n", err)
+			os.Exit(1)
 		}
-
-		for _, file := range result.Files {
-			remotePath := filepath.Join(path, file.Name)
-			if file.MimeType == "application/vnd.google-apps.folder" {
-				if err := fetchRemoteFiles(file.Id, remotePath, remoteFiles, srv); err != nil {
-					return err
-				}
-			} else {
-				remoteFiles[remotePath] = file
-			}
-		}
-
-		if result.NextPageToken == "" {
-			break
-		}
-		pageToken = result.NextPageToken
 	}
-	return nil
-}
 
-func uploadOrUpdateFile(filePath, relativePath, checksum string, remoteFiles map[string]*drive.File, parentID string, folderCache map[string]string, srv *drive.Service) error {
-	remoteFile, exists := remoteFiles[relativePath]
-	if exists {
-		if remoteFile.Md5Checksum == checksum {
-			fmt.Printf("File already exists and is identical: %s\n", relativePath)
-			return nil
-		}
-		fmt.Printf("Updating file: %s\n", relativePath)
-		return updateFile(filePath, remoteFile.Id, srv)
-	}
+	var wg sync.WaitGroup
 
-	fmt.Printf("Uploading new file: %s\n", relativePath)
-	return uploadFile(filePath, relativePath, parentID, folderCache, srv)
-}
+	for localDir, raw := range localServerDirMap {
+		wg.Add(1)
+		go func(localDir, raw string) {
+			defer wg.Done()
 
-func deleteRemoteFiles(localFiles map[string]string, remoteFiles map[string]*drive.File, srv *drive.Service) error {
-	for remotePath, remoteFile := range remoteFiles {
-		if _, exists := localFiles[remotePath]; !exists {
-			fmt.Printf("Deleting remote file: %s\n", remotePath)
-			if err := srv.Files.Delete(remoteFile.Id).Do(); err != nil {
-				return fmt.Errorf("failed to delete file %s: %v", remotePath, err)
+			backend, err := newBackend(specs[localDir], srv, httpClient, p, opts)
+			if err != nil {
+				fmt.Printf("Error building backend for %s: %v\n", localDir, err)
+				return
 			}
-		}
-	}
-	return nil
-}
-
-func computeMD5(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", fmt.Errorf("unable to open file: %v", err)
-	}
-	defer file.Close()
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", fmt.Errorf("unable to compute hash: %v", err)
-	}
-
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
-}
-
-func updateFile(filePath, fileID string, srv *drive.Service) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("unable to open file: %v", err)
-	}
-	defer file.Close()
-
-	_, err = srv.Files.Update(fileID, nil).Media(file).Do()
-	if err != nil {
-		return fmt.Errorf("unable to update file: %v", err)
+			fmt.Printf("Syncing %s with %s\n", localDir, raw)
+			if err := syncFiles(localDir, raw, backend, opts); err != nil {
+				fmt.Printf("Error syncing files for %s: %v\n", localDir, err)
+			}
+		}(localDir, raw)
 	}
 
-	fmt.Printf("Updated: %s\n", filePath)
-	return nil
+	wg.Wait()
+	fmt.Println("Sync completed successfully!")
 }
 
-func uploadFile(filePath, relativePath, parentID string, folderCache map[string]string, srv *drive.Service) error {
-	drivePathParts := strings.Split(filepath.ToSlash(relativePath), "/")
-	var err error
-
-	for i, part := range drivePathParts[:len(drivePathParts)-1] {
-		cacheKey := strings.Join(drivePathParts[:i+1], "/")
-		if cachedID, found := folderCache[cacheKey]; found {
-			parentID = cachedID
-			continue
-		}
-
-		parentID, err = createOrGetFolder(part, parentID, srv)
-		if err != nil {
-			return fmt.Errorf("unable to create or get folder '%s': %v", cacheKey, err)
-		}
-		folderCache[cacheKey] = parentID
-	}
-
-	fileName := drivePathParts[len(drivePathParts)-1]
-	file, err := os.Open(filePath)
+// getDriveService returns both the high-level Drive SDK client (used for
+// listing, folder creation and deletes) and the underlying authenticated
+// http.Client (used for the hand-rolled resumable upload protocol, which
+// needs direct control over session URIs that the SDK doesn't expose).
+func getDriveService() (*drive.Service, *http.Client, error) {
+	ctx := context.Background()
+	srv, err := drive.NewService(ctx, option.WithCredentialsFile(credFilePath))
 	if err != nil {
-		return fmt.Errorf("unable to open file: %v", err)
+		return nil, nil, fmt.Errorf("unable to create Drive service: %v", err)
 	}
-	defer file.Close()
 
-	driveFile := &drive.File{
-		Name:    fileName,
-		Parents: []string{parentID},
-	}
-
-	_, err = srv.Files.Create(driveFile).Media(file).Do()
+	httpClient, _, err := htransport.NewClient(ctx, option.WithCredentialsFile(credFilePath), option.WithScopes(drive.DriveScope))
 	if err != nil {
-		return fmt.Errorf("unable to upload file: %v", err)
+		return nil, nil, fmt.Errorf("unable to create authenticated http client: %v", err)
 	}
 
-	fmt.Printf("Uploaded: %s\n", filePath)
-	return nil
+	return srv, httpClient, nil
 }
 
-func createOrGetFolder(folderName, parentID string, srv *drive.Service) (string, error) {
-	query := fmt.Sprintf("name='%s' and '%s' in parents and mimeType='application/vnd.google-apps.folder' and trashed=false", folderName, parentID)
-	result, err := srv.Files.List().Q(query).Fields("files(id)").Do()
+// syncFiles lists backend's current file set and hands off to the
+// mode-specific implementation (push/pull/bisync, see sync_mode.go) that
+// reconciles it against localDir. mappingKey is the raw dir_map.json entry
+// ("gdrive:FOLDERID", "file:/path", ...), used to key bisync's persisted
+// baseline.
+func syncFiles(localDir, mappingKey string, backend Backend, opts *syncOptions) error {
+	remoteFiles, err := backend.List(opts.FullScan)
 	if err != nil {
-		return "", fmt.Errorf("unable to query folders: %v", err)
+		return fmt.Errorf("failed to list remote files: %v", err)
 	}
 
-	if len(result.Files) > 0 {
-		return result.Files[0].Id, nil
+	switch opts.Mode {
+	case modePull:
+		return runPull(localDir, backend, remoteFiles, opts)
+	case modeBisync:
+		return runBisync(localDir, mappingKey, backend, remoteFiles, opts)
+	default:
+		return runPush(localDir, backend, remoteFiles, opts)
 	}
-
-	// Folder doesn't exist, create it
-	folder := &drive.File{
-		Name:     folderName,
-		MimeType: "application/vnd.google-apps.folder",
-		Parents:  []string{parentID},
-	}
-
-	createdFolder, err := srv.Files.Create(folder).Do()
-	if err != nil {
-		return "", fmt.Errorf("unable to create folder: %v", err)
-	}
-
-	return createdFolder.Id, nil
 }
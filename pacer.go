@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	pacerMinSleep   = 10 * time.Millisecond
+	pacerMaxSleep   = 2 * time.Second
+	pacerDecay      = 2
+	pacerMaxRetries = 10
+)
+
+// pacer funnels every Drive API call through a shared, adaptively-paced
+// gate so a burst of concurrent goroutines doesn't trip rateLimitExceeded.
+// It mirrors rclone's Drive backend: the sleep between calls grows
+// exponentially on a retryable error and decays back toward minSleep once
+// calls start succeeding again.
+type pacer struct {
+	mu        sync.Mutex
+	sleepTime time.Duration
+	minSleep  time.Duration
+	maxSleep  time.Duration
+}
+
+func newPacer(minSleep, maxSleep time.Duration) *pacer {
+	return &pacer{sleepTime: minSleep, minSleep: minSleep, maxSleep: maxSleep}
+}
+
+func (p *pacer) wait() {
+	p.mu.Lock()
+	sleep := p.sleepTime
+	p.mu.Unlock()
+
+	jitter := time.Duration(rand.Int63n(int64(sleep) + 1))
+	time.Sleep(sleep/2 + jitter/2)
+}
+
+func (p *pacer) grow() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sleepTime *= pacerDecay
+	if p.sleepTime > p.maxSleep {
+		p.sleepTime = p.maxSleep
+	}
+}
+
+func (p *pacer) decay() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sleepTime /= pacerDecay
+	if p.sleepTime < p.minSleep {
+		p.sleepTime = p.minSleep
+	}
+}
+
+// call runs fn, retrying with jittered exponential backoff on retryable
+// Drive errors (403/429 rate limiting, 5xx) up to pacerMaxRetries times. On
+// success the shared sleep decays back toward minSleep; on a retryable
+// failure it grows toward maxSleep for every caller sharing this pacer.
+func (p *pacer) call(fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= pacerMaxRetries; attempt++ {
+		p.wait()
+
+		err = fn()
+		if err == nil {
+			p.decay()
+			return nil
+		}
+
+		if !isRetryableError(err) {
+			return err
+		}
+
+		p.grow()
+	}
+	return fmt.Errorf("exceeded %d retries: %v", pacerMaxRetries, err)
+}
+
+func isRetryableError(err error) bool {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return isRetryableCode(gErr.Code, gErr.Errors)
+	}
+	return false
+}
+
+func isRetryableCode(code int, errs []googleapi.ErrorItem) bool {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return true
+	case code == http.StatusForbidden:
+		for _, e := range errs {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+		return false
+	case code >= 500:
+		return true
+	default:
+		return false
+	}
+}
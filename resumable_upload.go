@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// defaultChunkSize is the per-request upload size used when the operator
+	// doesn't override it with --chunk-size. Must stay a multiple of 256 KiB
+	// per Drive's resumable upload requirement.
+	defaultChunkSize = 8 * 1024 * 1024
+	minChunkSize     = 256 * 1024
+
+	uploadStateFilePath  = ".cloudsyncer-upload-state.json"
+	driveUploadURL       = "https://www.googleapis.com/upload/drive/v3/files"
+	driveUploadURLForOne = "https://www.googleapis.com/upload/drive/v3/files/%s"
+)
+
+// uploadSession remembers the resumable session URI for a file that was
+// still uploading when the process last exited, so the next run can pick up
+// where it left off instead of re-sending bytes Drive already has.
+type uploadSession struct {
+	SessionURI string `json:"sessionUri"`
+}
+
+// normalizeChunkSize clamps chunkSize to Drive's requirements: at least
+// minChunkSize and a multiple of 256 KiB.
+func normalizeChunkSize(chunkSize int) int {
+	if chunkSize < minChunkSize {
+		return minChunkSize
+	}
+	return chunkSize - (chunkSize % minChunkSize)
+}
+
+// uploadStateMu serializes every load-mutate-save round trip against
+// uploadStateFilePath. The worker pool (sync_mode.go's runConcurrent) calls
+// resumableUpload from several goroutines at once, and each holds its own
+// stateKey entry in an otherwise-shared file, so without this the loser of
+// two concurrent saves would silently drop the winner's session-URI write.
+var uploadStateMu sync.Mutex
+
+func loadUploadState() (map[string]uploadSession, error) {
+	state := map[string]uploadSession{}
+	bx, err := os.ReadFile(uploadStateFilePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read upload state: %v", err)
+	}
+	if err := json.Unmarshal(bx, &state); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal upload state: %v", err)
+	}
+	return state, nil
+}
+
+func saveUploadState(state map[string]uploadSession) error {
+	bx, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal upload state: %v", err)
+	}
+	if err := os.WriteFile(uploadStateFilePath, bx, 0644); err != nil {
+		return fmt.Errorf("unable to write upload state: %v", err)
+	}
+	return nil
+}
+
+// uploadStateEntry returns the currently persisted session for stateKey,
+// under uploadStateMu so it can't observe a half-written save from another
+// goroutine.
+func uploadStateEntry(stateKey string) (uploadSession, error) {
+	uploadStateMu.Lock()
+	defer uploadStateMu.Unlock()
+
+	state, err := loadUploadState()
+	if err != nil {
+		return uploadSession{}, err
+	}
+	return state[stateKey], nil
+}
+
+// updateUploadState loads the persisted upload state, applies mutate to it,
+// and saves the result, all under uploadStateMu so the load-mutate-save
+// round trip is one atomic critical section shared by every concurrent
+// upload in the process.
+func updateUploadState(mutate func(state map[string]uploadSession)) error {
+	uploadStateMu.Lock()
+	defer uploadStateMu.Unlock()
+
+	state, err := loadUploadState()
+	if err != nil {
+		return err
+	}
+	mutate(state)
+	return saveUploadState(state)
+}
+
+func uploadStateKey(relativePath, checksum string) string {
+	return relativePath + ":" + checksum
+}
+
+// resumableUpload drives Drive's resumable upload protocol directly (rather
+// than the SDK's buffer-and-send Media().Do()) so the session URI can be
+// persisted to disk and reused across process restarts. method is "POST" to
+// create a new file or "PATCH" to update the file url names in place. Every HTTP round
+// trip goes through p so a pile of concurrent uploads backs off together
+// instead of each hammering Drive independently.
+func resumableUpload(httpClient *http.Client, method, url string, metadata []byte, filePath, stateKey string, chunkSize int, p *pacer) (*drive.File, error) {
+	chunkSize = normalizeChunkSize(chunkSize)
+
+	session, err := uploadStateEntry(stateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat file: %v", err)
+	}
+	totalSize := info.Size()
+
+	sessionURI := session.SessionURI
+	var offset int64
+	var completed *drive.File
+
+	if sessionURI != "" {
+		offset, completed, err = resumeOffset(httpClient, sessionURI, totalSize, p)
+		if err != nil {
+			// The session likely expired; fall back to starting a new one.
+			sessionURI = ""
+		}
+	}
+
+	if sessionURI == "" && completed == nil {
+		sessionURI, err = startResumableSession(httpClient, method, url, metadata, p)
+		if err != nil {
+			return nil, err
+		}
+		if err := updateUploadState(func(state map[string]uploadSession) {
+			state[stateKey] = uploadSession{SessionURI: sessionURI}
+		}); err != nil {
+			return nil, err
+		}
+		offset = 0
+	}
+
+	result := completed
+	if result == nil {
+		result, err = uploadChunks(httpClient, sessionURI, file, offset, totalSize, chunkSize, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := updateUploadState(func(state map[string]uploadSession) {
+		delete(state, stateKey)
+	}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func startResumableSession(httpClient *http.Client, method, url string, metadata []byte, p *pacer) (string, error) {
+	var sessionURI string
+	err := p.call(func() error {
+		req, err := http.NewRequest(method, url, bytes.NewReader(metadata))
+		if err != nil {
+			return fmt.Errorf("unable to build resumable session request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to start resumable session: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+
+		sessionURI = resp.Header.Get("Location")
+		if sessionURI == "" {
+			return fmt.Errorf("resumable session response missing Location header")
+		}
+		return nil
+	})
+	return sessionURI, err
+}
+
+// resumeOffset asks Drive how many bytes of a previously started session it
+// already has, per the resumable upload status-check protocol (an empty PUT
+// with a Content-Range of bytes */total-size). If Drive reports the upload
+// already finished (e.g. the process crashed after the last chunk PUT
+// succeeded but before the state file was updated), it returns the decoded
+// file from that response instead of an offset to resume from.
+func resumeOffset(httpClient *http.Client, sessionURI string, totalSize int64, p *pacer) (int64, *drive.File, error) {
+	var offset int64
+	var completed *drive.File
+	err := p.call(func() error {
+		req, err := http.NewRequest(http.MethodPut, sessionURI, nil)
+		if err != nil {
+			return fmt.Errorf("unable to build resume status request: %v", err)
+		}
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
+		req.ContentLength = 0
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to query resume status: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == 308 {
+			rangeHeader := resp.Header.Get("Range")
+			if rangeHeader == "" {
+				offset = 0
+				return nil
+			}
+			var lo, hi int64
+			if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &lo, &hi); err != nil {
+				return fmt.Errorf("unable to parse Range header %q: %v", rangeHeader, err)
+			}
+			offset = hi + 1
+			return nil
+		}
+
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+
+		var decoded drive.File
+		if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+			return fmt.Errorf("unable to decode completed upload response: %v", err)
+		}
+		offset = totalSize
+		completed = &decoded
+		return nil
+	})
+	return offset, completed, err
+}
+
+func uploadChunks(httpClient *http.Client, sessionURI string, file *os.File, offset, totalSize int64, chunkSize int, p *pacer) (*drive.File, error) {
+	buf := make([]byte, chunkSize)
+
+	for offset < totalSize {
+		var (
+			result *drive.File
+			done   bool
+		)
+
+		err := p.call(func() error {
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return fmt.Errorf("unable to seek to offset %d: %v", offset, err)
+			}
+
+			n, err := io.ReadFull(file, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return fmt.Errorf("unable to read chunk at offset %d: %v", offset, err)
+			}
+
+			req, err := http.NewRequest(http.MethodPut, sessionURI, bytes.NewReader(buf[:n]))
+			if err != nil {
+				return fmt.Errorf("unable to build chunk request: %v", err)
+			}
+			req.ContentLength = int64(n)
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, totalSize))
+
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				return fmt.Errorf("unable to upload chunk at offset %d: %v", offset, err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode == 308 {
+				offset += int64(n)
+				return nil
+			}
+
+			if err := googleapi.CheckResponse(resp); err != nil {
+				return err
+			}
+
+			var decoded drive.File
+			if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+				return fmt.Errorf("unable to decode upload response: %v", err)
+			}
+			result = &decoded
+			done = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return result, nil
+		}
+	}
+
+	return nil, fmt.Errorf("upload loop exited without a final response")
+}
+
+func mustJSON(v interface{}) []byte {
+	bx, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("unable to marshal %T: %v", v, err))
+	}
+	return bx
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type syncMode string
+
+const (
+	modePush   syncMode = "push"
+	modePull   syncMode = "pull"
+	modeBisync syncMode = "bisync"
+)
+
+func parseSyncMode(raw string) (syncMode, error) {
+	switch syncMode(raw) {
+	case modePush, modePull, modeBisync:
+		return syncMode(raw), nil
+	default:
+		return "", fmt.Errorf("invalid --mode %q (want push, pull, or bisync)", raw)
+	}
+}
+
+type conflictPolicy string
+
+const (
+	conflictNewer  conflictPolicy = "newer"
+	conflictLarger conflictPolicy = "larger"
+	conflictLocal  conflictPolicy = "local"
+	conflictRemote conflictPolicy = "remote"
+	conflictRename conflictPolicy = "rename"
+)
+
+func parseConflictPolicy(raw string) (conflictPolicy, error) {
+	switch conflictPolicy(raw) {
+	case conflictNewer, conflictLarger, conflictLocal, conflictRemote, conflictRename:
+		return conflictPolicy(raw), nil
+	default:
+		return "", fmt.Errorf("invalid --conflict %q (want newer, larger, local, remote, or rename)", raw)
+	}
+}
+
+type localFileInfo struct {
+	Checksum string
+	ModTime  time.Time
+	Size     int64
+}
+
+// walkLocalFiles hashes every file under localDir with hash, the same digest
+// the backend being synced against uses, so the two sides are comparable.
+// Files and directories ruled out by filters are skipped entirely (and, for
+// directories, never descended into) rather than hashed and then discarded.
+func walkLocalFiles(localDir string, hash HashType, filters *syncFilters) (map[string]localFileInfo, error) {
+	localFiles := make(map[string]localFileInfo)
+
+	err := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(localDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to compute relative path: %v", err)
+		}
+
+		if info.IsDir() {
+			if relativePath != "." && filters.dirExcluded(localDir, relativePath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if filters.excluded(localDir, relativePath, info.Size()) {
+			return nil
+		}
+
+		checksum, err := hash.computeLocal(path)
+		if err != nil {
+			return fmt.Errorf("failed to compute checksum for %s: %v", path, err)
+		}
+
+		localFiles[relativePath] = localFileInfo{Checksum: checksum, ModTime: info.ModTime(), Size: info.Size()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return localFiles, nil
+}
+
+// runConcurrent fans work for each key out across a pool bounded by limit,
+// matching the pacing/concurrency model syncFiles used before it grew mode
+// variants.
+func runConcurrent(keys []string, limit int, fn func(key string) error) error {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr error
+
+	for _, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(key); err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+			}
+		}(key)
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// uploadOrUpdateFile syncs one local file to backend: a no-op if the remote
+// copy already matches, an Update if it exists and differs, or an Upload if
+// it's new. It returns the backend's resulting view of the file (the
+// existing entry on a no-op) so callers that need the true post-operation
+// state — bisync's baseline snapshot, in particular — aren't stuck reusing
+// the pre-sync remoteFiles listing.
+func uploadOrUpdateFile(filePath, relativePath, checksum string, remoteFiles map[string]RemoteFile, backend Backend, opts *syncOptions) (RemoteFile, error) {
+	remote, exists := remoteFiles[relativePath]
+	if exists {
+		if remote.Hash == checksum {
+			fmt.Printf("File already exists and is identical: %s\n", relativePath)
+			return remote, nil
+		}
+		if opts.DryRun {
+			fmt.Printf("Would update file: %s\n", relativePath)
+			return remote, nil
+		}
+		return backend.Update(filePath, relativePath, remote)
+	}
+
+	if opts.DryRun {
+		fmt.Printf("Would upload new file: %s\n", relativePath)
+		return RemoteFile{}, nil
+	}
+	return backend.Upload(filePath, relativePath)
+}
+
+// deleteRemoteFiles removes remote files with no local counterpart. A
+// remote path that filters would exclude is left alone either way: it's
+// not a sync candidate, so its absence from localChecksums (which only
+// tracks files the walk didn't filter out) doesn't mean it was deleted
+// locally.
+func deleteRemoteFiles(localDir string, localChecksums map[string]string, remoteFiles map[string]RemoteFile, backend Backend, opts *syncOptions) error {
+	for remotePath, remoteFile := range remoteFiles {
+		if _, exists := localChecksums[remotePath]; exists {
+			continue
+		}
+		if opts.Filters.excluded(localDir, remotePath, remoteFile.Size) {
+			continue
+		}
+		if opts.DryRun {
+			fmt.Printf("Would delete remote file: %s\n", remotePath)
+			continue
+		}
+		fmt.Printf("Deleting remote file: %s\n", remotePath)
+		if err := backend.Delete(remoteFile); err != nil {
+			return fmt.Errorf("failed to delete file %s: %v", remotePath, err)
+		}
+	}
+	return nil
+}
+
+// runPush is the original local -> remote behavior: upload/update every
+// local file, then delete anything remote that has no local counterpart.
+func runPush(localDir string, backend Backend, remoteFiles map[string]RemoteFile, opts *syncOptions) error {
+	localFiles, err := walkLocalFiles(localDir, backend.Hash(), opts.Filters)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(localFiles))
+	for relativePath := range localFiles {
+		keys = append(keys, relativePath)
+	}
+
+	if err := runConcurrent(keys, opts.Transfers, func(relativePath string) error {
+		info := localFiles[relativePath]
+		path := filepath.Join(localDir, relativePath)
+		if _, err := uploadOrUpdateFile(path, relativePath, info.Checksum, remoteFiles, backend, opts); err != nil {
+			return fmt.Errorf("failed to sync %s: %v", relativePath, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	localChecksums := make(map[string]string, len(localFiles))
+	for relativePath, info := range localFiles {
+		localChecksums[relativePath] = info.Checksum
+	}
+
+	if err := deleteRemoteFiles(localDir, localChecksums, remoteFiles, backend, opts); err != nil {
+		return fmt.Errorf("failed to delete remote files: %v", err)
+	}
+
+	return nil
+}
+
+// runPull is push's mirror image: download anything remote that's missing
+// or different locally, then delete local files with no remote counterpart.
+func runPull(localDir string, backend Backend, remoteFiles map[string]RemoteFile, opts *syncOptions) error {
+	localFiles, err := walkLocalFiles(localDir, backend.Hash(), opts.Filters)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(remoteFiles))
+	for relativePath := range remoteFiles {
+		keys = append(keys, relativePath)
+	}
+
+	if err := runConcurrent(keys, opts.Transfers, func(relativePath string) error {
+		remote := remoteFiles[relativePath]
+		if opts.Filters.excluded(localDir, relativePath, remote.Size) {
+			return nil
+		}
+		local, exists := localFiles[relativePath]
+		if exists && local.Checksum == remote.Hash {
+			fmt.Printf("File already exists and is identical: %s\n", relativePath)
+			return nil
+		}
+
+		destPath := filepath.Join(localDir, relativePath)
+		if opts.DryRun {
+			fmt.Printf("Would download: %s\n", relativePath)
+			return nil
+		}
+		fmt.Printf("Downloading: %s\n", relativePath)
+		if err := backend.Download(remote, destPath); err != nil {
+			return fmt.Errorf("failed to download %s: %v", relativePath, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for relativePath := range localFiles {
+		if _, exists := remoteFiles[relativePath]; exists {
+			continue
+		}
+		if opts.DryRun {
+			fmt.Printf("Would delete local file: %s\n", relativePath)
+			continue
+		}
+		fmt.Printf("Deleting local file: %s\n", relativePath)
+		if err := os.Remove(filepath.Join(localDir, relativePath)); err != nil {
+			return fmt.Errorf("failed to delete local file %s: %v", relativePath, err)
+		}
+	}
+
+	return nil
+}
+
+// runBisync reconciles localDir and backend in both directions, using the
+// bisync baseline recorded after the last run (keyed by mappingKey, the raw
+// dir_map.json entry) to tell which side actually changed rather than just
+// which side differs from the other.
+func runBisync(localDir, mappingKey string, backend Backend, remoteFiles map[string]RemoteFile, opts *syncOptions) error {
+	localFiles, err := walkLocalFiles(localDir, backend.Hash(), opts.Filters)
+	if err != nil {
+		return err
+	}
+
+	baseline, err := loadBisyncBaseline(mappingKey)
+	if err != nil {
+		return err
+	}
+
+	paths := make(map[string]struct{}, len(localFiles)+len(remoteFiles)+len(baseline))
+	for path := range localFiles {
+		paths[path] = struct{}{}
+	}
+	for path := range remoteFiles {
+		paths[path] = struct{}{}
+	}
+	for path := range baseline {
+		paths[path] = struct{}{}
+	}
+
+	newBaseline := make(map[string]bisyncBaseline, len(paths))
+
+	for path := range paths {
+		local, localExists := localFiles[path]
+		remote, remoteExists := remoteFiles[path]
+		base, hadBase := baseline[path]
+
+		sizeHint := local.Size
+		if remoteExists {
+			sizeHint = remote.Size
+		}
+		if opts.Filters.excluded(localDir, path, sizeHint) {
+			continue
+		}
+
+		localChanged := localExists && (!hadBase || local.Checksum != base.LocalChecksum)
+		remoteChanged := remoteExists && (!hadBase || remote.Hash != base.RemoteChecksum)
+		localDeleted := hadBase && !localExists
+		remoteDeleted := hadBase && !remoteExists
+
+		fullLocalPath := filepath.Join(localDir, path)
+		keep := true
+
+		push := func() error {
+			if opts.DryRun {
+				fmt.Printf("Would push local change to remote: %s\n", path)
+				return nil
+			}
+			result, err := uploadOrUpdateFile(fullLocalPath, path, local.Checksum, remoteFiles, backend, opts)
+			if err != nil {
+				return err
+			}
+			// Record what the backend actually has now, not the pre-push
+			// listing, so the baseline snapshot below doesn't look stale on
+			// the very next run (see bisyncEntrySnapshot).
+			remoteFiles[path] = result
+			return nil
+		}
+		pull := func() error {
+			if opts.DryRun {
+				fmt.Printf("Would pull remote change to local: %s\n", path)
+				return nil
+			}
+			fmt.Printf("Pulling: %s\n", path)
+			return backend.Download(remote, fullLocalPath)
+		}
+		deleteLocal := func() error {
+			if opts.DryRun {
+				fmt.Printf("Would delete local file: %s\n", path)
+				return nil
+			}
+			fmt.Printf("Deleting local file: %s\n", path)
+			return os.Remove(fullLocalPath)
+		}
+		deleteRemote := func() error {
+			if opts.DryRun {
+				fmt.Printf("Would delete remote file: %s\n", path)
+				return nil
+			}
+			fmt.Printf("Deleting remote file: %s\n", path)
+			return backend.Delete(remote)
+		}
+
+		switch {
+		case localDeleted && remoteDeleted:
+			keep = false
+
+		case localDeleted && !remoteChanged:
+			if err := deleteRemote(); err != nil {
+				return fmt.Errorf("failed to delete %s: %v", path, err)
+			}
+			keep = false
+
+		case remoteDeleted && !localChanged:
+			if err := deleteLocal(); err != nil {
+				return fmt.Errorf("failed to delete %s: %v", path, err)
+			}
+			keep = false
+
+		case localDeleted && remoteChanged:
+			if opts.Conflict == conflictLocal {
+				if err := deleteRemote(); err != nil {
+					return fmt.Errorf("failed to delete %s: %v", path, err)
+				}
+				keep = false
+			} else {
+				if err := pull(); err != nil {
+					return fmt.Errorf("failed to sync %s: %v", path, err)
+				}
+			}
+
+		case remoteDeleted && localChanged:
+			if opts.Conflict == conflictRemote {
+				if err := deleteLocal(); err != nil {
+					return fmt.Errorf("failed to delete %s: %v", path, err)
+				}
+				keep = false
+			} else {
+				if err := push(); err != nil {
+					return fmt.Errorf("failed to sync %s: %v", path, err)
+				}
+			}
+
+		case localChanged && remoteChanged:
+			if local.Checksum == remote.Hash {
+				// Both sides converged on the same content independently.
+				break
+			}
+			if err := resolveBisyncConflict(path, fullLocalPath, local, remote, backend, opts, push, pull); err != nil {
+				return fmt.Errorf("failed to resolve conflict for %s: %v", path, err)
+			}
+
+		case localChanged:
+			if err := push(); err != nil {
+				return fmt.Errorf("failed to sync %s: %v", path, err)
+			}
+
+		case remoteChanged:
+			if err := pull(); err != nil {
+				return fmt.Errorf("failed to sync %s: %v", path, err)
+			}
+		}
+
+		if keep {
+			newBaseline[path] = bisyncEntrySnapshot(path, localDir, backend.Hash(), remoteFiles)
+		}
+	}
+
+	if opts.DryRun {
+		return nil
+	}
+
+	return saveBisyncBaseline(mappingKey, newBaseline)
+}
+
+// resolveBisyncConflict applies opts.Conflict when both sides changed since
+// the last run. For "rename" the losing side is preserved under a
+// name.conflict-<timestamp>.ext copy before the winner overwrites it.
+func resolveBisyncConflict(path, fullLocalPath string, local localFileInfo, remote RemoteFile, backend Backend, opts *syncOptions, push, pull func() error) error {
+	winner := resolveConflictWinner(opts.Conflict, local, remote)
+
+	if opts.Conflict == conflictRename && !opts.DryRun {
+		if winner == "remote" {
+			if err := os.Rename(fullLocalPath, conflictFileName(fullLocalPath)); err != nil {
+				return fmt.Errorf("unable to preserve conflicting local copy: %v", err)
+			}
+		} else {
+			if err := backend.Rename(remote, conflictFileName(filepath.Base(remote.Path))); err != nil {
+				return fmt.Errorf("unable to preserve conflicting remote copy: %v", err)
+			}
+		}
+	} else if opts.Conflict == conflictRename {
+		losingSide := map[string]string{"remote": "local", "local": "remote"}[winner]
+		fmt.Printf("Would preserve conflicting %s copy: %s\n", losingSide, path)
+	}
+
+	if winner == "remote" {
+		return pull()
+	}
+	return push()
+}
+
+func resolveConflictWinner(policy conflictPolicy, local localFileInfo, remote RemoteFile) string {
+	switch policy {
+	case conflictLocal:
+		return "local"
+	case conflictRemote:
+		return "remote"
+	case conflictLarger:
+		if local.Size >= remote.Size {
+			return "local"
+		}
+		return "remote"
+	default: // newer, rename
+		if local.ModTime.After(remote.ModTime) {
+			return "local"
+		}
+		return "remote"
+	}
+}
+
+func conflictFileName(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	return fmt.Sprintf("%s.conflict-%d%s", base, time.Now().Unix(), ext)
+}
+
+// bisyncEntrySnapshot records the post-reconciliation state of path so the
+// next run can tell what changed since this one. It re-hashes the local
+// file because a push/pull/conflict resolution may have just touched it.
+func bisyncEntrySnapshot(path, localDir string, hash HashType, remoteFiles map[string]RemoteFile) bisyncBaseline {
+	var entry bisyncBaseline
+
+	localPath := filepath.Join(localDir, path)
+	if info, err := os.Stat(localPath); err == nil {
+		if checksum, err := hash.computeLocal(localPath); err == nil {
+			entry.LocalChecksum = checksum
+			entry.LocalModTime = info.ModTime()
+		}
+	}
+
+	if remote, ok := remoteFiles[path]; ok {
+		entry.RemoteChecksum = remote.Hash
+		entry.RemoteModTime = remote.ModTime
+	}
+
+	return entry
+}
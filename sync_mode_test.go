@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveConflictWinner(t *testing.T) {
+	older := time.Now().Add(-time.Hour)
+	newer := time.Now()
+
+	tests := []struct {
+		name   string
+		policy conflictPolicy
+		local  localFileInfo
+		remote RemoteFile
+		want   string
+	}{
+		{
+			name:   "local policy always wins",
+			policy: conflictLocal,
+			local:  localFileInfo{ModTime: older, Size: 1},
+			remote: RemoteFile{ModTime: newer, Size: 100},
+			want:   "local",
+		},
+		{
+			name:   "remote policy always wins",
+			policy: conflictRemote,
+			local:  localFileInfo{ModTime: newer, Size: 100},
+			remote: RemoteFile{ModTime: older, Size: 1},
+			want:   "remote",
+		},
+		{
+			name:   "larger policy picks the bigger file",
+			policy: conflictLarger,
+			local:  localFileInfo{Size: 50},
+			remote: RemoteFile{Size: 100},
+			want:   "remote",
+		},
+		{
+			name:   "larger policy favors local on a tie",
+			policy: conflictLarger,
+			local:  localFileInfo{Size: 50},
+			remote: RemoteFile{Size: 50},
+			want:   "local",
+		},
+		{
+			name:   "newer policy picks the more recent mod time",
+			policy: conflictNewer,
+			local:  localFileInfo{ModTime: newer},
+			remote: RemoteFile{ModTime: older},
+			want:   "local",
+		},
+		{
+			name:   "newer policy favors remote on a tie",
+			policy: conflictNewer,
+			local:  localFileInfo{ModTime: older},
+			remote: RemoteFile{ModTime: older},
+			want:   "remote",
+		},
+		{
+			name:   "rename policy falls back to newer",
+			policy: conflictRename,
+			local:  localFileInfo{ModTime: older},
+			remote: RemoteFile{ModTime: newer},
+			want:   "remote",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveConflictWinner(tt.policy, tt.local, tt.remote); got != tt.want {
+				t.Errorf("resolveConflictWinner(%v) = %q, want %q", tt.policy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConflictFileName(t *testing.T) {
+	got := conflictFileName("/tmp/sync/report.pdf")
+	dir, ext := "/tmp/sync/report", ".pdf"
+	if !hasPrefixSuffix(got, dir+".conflict-", ext) {
+		t.Errorf("conflictFileName(...) = %q, want prefix %q and suffix %q", got, dir+".conflict-", ext)
+	}
+}
+
+func hasPrefixSuffix(s, prefix, suffix string) bool {
+	return len(s) >= len(prefix)+len(suffix) && s[:len(prefix)] == prefix && s[len(s)-len(suffix):] == suffix
+}
+
+// TestRunBisyncPreservesLocalEditOverStaleRemoteBaseline exercises runBisync
+// across two runs against a fileBackend. It reproduces a regression where
+// the baseline snapshot taken after a push reused the pre-push remoteFiles
+// listing instead of what was actually uploaded: on the next run the
+// freshly-listed remote hash no longer matched that stale baseline, so a
+// plain local edit looked like a remote+local conflict and, under
+// --conflict=remote, got silently reverted by a pull of the old content.
+func TestRunBisyncPreservesLocalEditOverStaleRemoteBaseline(t *testing.T) {
+	// loadBisyncBaseline/saveBisyncBaseline persist to a fixed path relative
+	// to the working directory, so give this test its own to avoid touching
+	// the repo's real state file.
+	oldWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(oldWd) })
+
+	localDir := t.TempDir()
+	remoteDir := t.TempDir()
+	backend := newFileBackend(remoteDir)
+	mappingKey := "file:" + remoteDir
+
+	opts := &syncOptions{
+		Transfers: 1,
+		Mode:      modeBisync,
+		Conflict:  conflictRemote,
+		Filters:   &syncFilters{},
+	}
+
+	filePath := filepath.Join(localDir, "a.txt")
+	if err := os.WriteFile(filePath, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteFiles, err := backend.List(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runBisync(localDir, mappingKey, backend, remoteFiles, opts); err != nil {
+		t.Fatalf("first bisync run (push a.txt): %v", err)
+	}
+
+	// Edit the local file again with no remote-side change in between.
+	if err := os.WriteFile(filePath, []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteFiles, err = backend.List(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runBisync(localDir, mappingKey, backend, remoteFiles, opts); err != nil {
+		t.Fatalf("second bisync run: %v", err)
+	}
+
+	got, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "edited" {
+		t.Errorf("local edit was reverted: got %q, want %q", got, "edited")
+	}
+}